@@ -0,0 +1,213 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoundTripUnsafeMethodInvalidatesAllVaryVariants(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write([]byte("hello, " + r.Header.Get("Accept-Encoding")))
+	}))
+	defer server.Close()
+
+	cache := NewMemoryCache()
+	transport := NewTransport(cache)
+	client := transport.Client()
+
+	gzipReq, _ := http.NewRequest("GET", server.URL, nil)
+	gzipReq.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(gzipReq)
+	if err != nil {
+		t.Fatalf("gzip GET failed: %s", err)
+	}
+	resp.Body.Close()
+
+	identityReq, _ := http.NewRequest("GET", server.URL, nil)
+	identityReq.Header.Set("Accept-Encoding", "identity")
+	resp, err = client.Do(identityReq)
+	if err != nil {
+		t.Fatalf("identity GET failed: %s", err)
+	}
+	resp.Body.Close()
+
+	// Confirm both variants actually landed in the cache before invalidating them.
+	resp, err = client.Do(gzipReq)
+	if err != nil {
+		t.Fatalf("gzip re-GET failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(XFromCache) == "" {
+		t.Fatalf("expected gzip variant to be cached before invalidation")
+	}
+	resp, err = client.Do(identityReq)
+	if err != nil {
+		t.Fatalf("identity re-GET failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(XFromCache) == "" {
+		t.Fatalf("expected identity variant to be cached before invalidation")
+	}
+
+	postReq, _ := http.NewRequest("POST", server.URL, nil)
+	resp, err = client.Do(postReq)
+	if err != nil {
+		t.Fatalf("POST failed: %s", err)
+	}
+	resp.Body.Close()
+
+	// Check the indexes right after invalidation, before either variant is re-fetched (which
+	// would legitimately repopulate them).
+	baseKey := transport.baseCacheKey(gzipReq)
+	if vary := transport.varyHeaders(baseKey); len(vary) != 0 {
+		t.Errorf("expected the Vary index to be cleared by invalidation, got %v", vary)
+	}
+	if variants := transport.knownVariantSuffixes(baseKey); len(variants) != 0 {
+		t.Errorf("expected the variants index to be cleared by invalidation, got %v", variants)
+	}
+
+	resp, err = client.Do(gzipReq)
+	if err != nil {
+		t.Fatalf("gzip GET after invalidation failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(XFromCache) != "" {
+		t.Errorf("expected gzip variant to be invalidated by the POST, still served from cache")
+	}
+
+	resp, err = client.Do(identityReq)
+	if err != nil {
+		t.Fatalf("identity GET after invalidation failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(XFromCache) != "" {
+		t.Errorf("expected identity variant to be invalidated by the POST, still served from cache")
+	}
+}
+
+func TestRoundTripAdmitRejectsResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	var evicted []EvictReason
+	transport := NewTransport(NewMemoryCache())
+	transport.Admit = func(req *http.Request, resp *http.Response) bool {
+		return false
+	}
+	transport.OnEvict = func(key string, reason EvictReason) {
+		evicted = append(evicted, reason)
+	}
+	client := transport.Client()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("first request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("second request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get(XFromCache) != "" {
+		t.Errorf("expected second response not to be served from cache, Admit rejected it")
+	}
+	if len(evicted) == 0 || evicted[0] != EvictReasonRejectedByAdmit {
+		t.Errorf("OnEvict reasons = %v, want a leading %v", evicted, EvictReasonRejectedByAdmit)
+	}
+}
+
+func TestRoundTripMaxBodyBytesSkipsCachingOversizedResponse(t *testing.T) {
+	const body = "0123456789"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	var evicted []EvictReason
+	transport := NewTransport(NewMemoryCache())
+	transport.MaxBodyBytes = int64(len(body) - 1)
+	transport.OnEvict = func(key string, reason EvictReason) {
+		evicted = append(evicted, reason)
+	}
+	client := transport.Client()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("first request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("second request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get(XFromCache) != "" {
+		t.Errorf("expected second response not to be served from cache, body exceeds MaxBodyBytes")
+	}
+	found := false
+	for _, reason := range evicted {
+		if reason == EvictReasonTooLarge {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("OnEvict reasons = %v, want a %v entry", evicted, EvictReasonTooLarge)
+	}
+}
+
+func TestRoundTripOnEvictInvalidatesOnUnsafeMethod(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	var evicted []EvictReason
+	transport := NewTransport(NewMemoryCache())
+	transport.OnEvict = func(key string, reason EvictReason) {
+		evicted = append(evicted, reason)
+	}
+	client := transport.Client()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	resp.Body.Close()
+
+	resp, err = client.Post(server.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatalf("POST failed: %s", err)
+	}
+	resp.Body.Close()
+
+	found := false
+	for _, reason := range evicted {
+		if reason == EvictReasonInvalidated {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("OnEvict reasons = %v, want a %v entry after the POST", evicted, EvictReasonInvalidated)
+	}
+}
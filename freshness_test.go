@@ -0,0 +1,453 @@
+package httpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeClock lets tests pin "now" to a fixed instant.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) since(d time.Time) time.Duration {
+	return c.t.Sub(d)
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func withFakeClock(now time.Time, fn func()) {
+	prev := clock
+	clock = &fakeClock{t: now}
+	defer func() { clock = prev }()
+	fn()
+}
+
+func formatRFC1123(t time.Time) string {
+	return t.UTC().Format(time.RFC1123)
+}
+
+func TestGetFreshness(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name         string
+		respHeaders  http.Header
+		reqHeaders   http.Header
+		statusCode   int
+		sharedCache  bool
+		heuristicCap time.Duration
+		want         int
+	}{
+		{
+			name:        "request no-cache is always transparent",
+			respHeaders: http.Header{"Date": {formatRFC1123(now)}},
+			reqHeaders:  http.Header{"Cache-Control": {"no-cache"}},
+			statusCode:  http.StatusOK,
+			want:        transparent,
+		},
+		{
+			name:        "bare response no-cache is stale",
+			respHeaders: http.Header{"Date": {formatRFC1123(now)}, "Cache-Control": {"no-cache"}},
+			statusCode:  http.StatusOK,
+			want:        stale,
+		},
+		{
+			name: "response no-cache=field doesn't force stale",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now)},
+				"Cache-Control": {`no-cache="set-cookie", max-age=60`},
+			},
+			statusCode: http.StatusOK,
+			want:       fresh,
+		},
+		{
+			name:        "only-if-cached in request is always fresh",
+			respHeaders: http.Header{},
+			reqHeaders:  http.Header{"Cache-Control": {"only-if-cached"}},
+			statusCode:  http.StatusOK,
+			want:        fresh,
+		},
+		{
+			name:        "missing Date header is stale",
+			respHeaders: http.Header{},
+			statusCode:  http.StatusOK,
+			want:        stale,
+		},
+		{
+			name: "max-age within lifetime is fresh",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-30 * time.Second))},
+				"Cache-Control": {"max-age=60"},
+			},
+			statusCode: http.StatusOK,
+			want:       fresh,
+		},
+		{
+			name: "max-age exceeded is stale",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60"},
+			},
+			statusCode: http.StatusOK,
+			want:       stale,
+		},
+		{
+			name: "Expires header honored when max-age absent",
+			respHeaders: http.Header{
+				"Date":    {formatRFC1123(now.Add(-30 * time.Second))},
+				"Expires": {formatRFC1123(now.Add(30 * time.Second))},
+			},
+			statusCode: http.StatusOK,
+			want:       fresh,
+		},
+		{
+			name: "max-age overrides a more permissive Expires",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60"},
+				"Expires":       {formatRFC1123(now.Add(1 * time.Hour))},
+			},
+			statusCode: http.StatusOK,
+			want:       stale,
+		},
+		{
+			name: "s-maxage honored for shared caches",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60, s-maxage=120"},
+			},
+			statusCode:  http.StatusOK,
+			sharedCache: true,
+			want:        fresh,
+		},
+		{
+			name: "s-maxage ignored for private caches",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60, s-maxage=120"},
+			},
+			statusCode:  http.StatusOK,
+			sharedCache: false,
+			want:        stale,
+		},
+		{
+			name: "heuristic freshness from Last-Modified",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-1 * time.Minute))},
+				"Last-Modified": {formatRFC1123(now.Add(-1 * time.Minute).Add(-100 * time.Minute))},
+			},
+			statusCode:   http.StatusOK,
+			heuristicCap: time.Hour,
+			want:         fresh, // 10% of 100min = 10min > 1min age
+		},
+		{
+			name: "heuristic freshness not applied to non-heuristically-cacheable status",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-1 * time.Minute))},
+				"Last-Modified": {formatRFC1123(now.Add(-1 * time.Minute).Add(-100 * time.Minute))},
+			},
+			statusCode:   http.StatusAccepted,
+			heuristicCap: time.Hour,
+			want:         stale,
+		},
+		{
+			name: "heuristic freshness capped",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-2 * time.Hour))},
+				"Last-Modified": {formatRFC1123(now.Add(-2 * time.Hour).Add(-1000 * time.Hour))},
+			},
+			statusCode:   http.StatusOK,
+			heuristicCap: time.Hour,
+			want:         stale, // 10% of 1000h = 100h, capped to 1h, age is 2h
+		},
+		{
+			name: "request min-fresh rejects a response that's about to expire",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-55 * time.Second))},
+				"Cache-Control": {"max-age=60"},
+			},
+			reqHeaders: http.Header{"Cache-Control": {"min-fresh=30"}},
+			statusCode: http.StatusOK,
+			want:       stale,
+		},
+		{
+			name: "request max-stale accepts an expired response",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60"},
+			},
+			reqHeaders: http.Header{"Cache-Control": {"max-stale=60"}},
+			statusCode: http.StatusOK,
+			want:       fresh,
+		},
+		{
+			name: "must-revalidate defeats request max-stale",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60, must-revalidate"},
+			},
+			reqHeaders: http.Header{"Cache-Control": {"max-stale"}},
+			statusCode: http.StatusOK,
+			want:       stale,
+		},
+		{
+			name: "proxy-revalidate only defeats max-stale for shared caches",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60, proxy-revalidate"},
+			},
+			reqHeaders:  http.Header{"Cache-Control": {"max-stale"}},
+			statusCode:  http.StatusOK,
+			sharedCache: false,
+			want:        fresh,
+		},
+		{
+			name: "stale-while-revalidate within its window",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60, stale-while-revalidate=60"},
+			},
+			statusCode: http.StatusOK,
+			want:       staleWhileRevalidate,
+		},
+		{
+			name: "stale-while-revalidate window exceeded",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-200 * time.Second))},
+				"Cache-Control": {"max-age=60, stale-while-revalidate=60"},
+			},
+			statusCode: http.StatusOK,
+			want:       stale,
+		},
+		{
+			name: "must-revalidate defeats stale-while-revalidate",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60, stale-while-revalidate=60, must-revalidate"},
+			},
+			statusCode: http.StatusOK,
+			want:       stale,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			withFakeClock(now, func() {
+				heuristicCap := tc.heuristicCap
+				if heuristicCap == 0 {
+					heuristicCap = defaultHeuristicFreshnessCap
+				}
+				got := getFreshness(tc.respHeaders, tc.reqHeaders, tc.statusCode, tc.sharedCache, heuristicCap)
+				if got != tc.want {
+					t.Errorf("getFreshness() = %d, want %d", got, tc.want)
+				}
+			})
+		})
+	}
+}
+
+func TestStaleIfErrorApplies(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name        string
+		respHeaders http.Header
+		statusCode  int
+		sharedCache bool
+		want        bool
+	}{
+		{
+			name: "within stale-if-error window",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60, stale-if-error=60"},
+			},
+			statusCode: http.StatusOK,
+			want:       true,
+		},
+		{
+			name: "stale-if-error window exceeded",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-200 * time.Second))},
+				"Cache-Control": {"max-age=60, stale-if-error=60"},
+			},
+			statusCode: http.StatusOK,
+			want:       false,
+		},
+		{
+			name: "no stale-if-error directive",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60"},
+			},
+			statusCode: http.StatusOK,
+			want:       false,
+		},
+		{
+			name: "must-revalidate defeats stale-if-error",
+			respHeaders: http.Header{
+				"Date":          {formatRFC1123(now.Add(-90 * time.Second))},
+				"Cache-Control": {"max-age=60, stale-if-error=60, must-revalidate"},
+			},
+			statusCode: http.StatusOK,
+			want:       false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			withFakeClock(now, func() {
+				got := staleIfErrorApplies(tc.respHeaders, tc.statusCode, tc.sharedCache, defaultHeuristicFreshnessCap)
+				if got != tc.want {
+					t.Errorf("staleIfErrorApplies() = %v, want %v", got, tc.want)
+				}
+			})
+		})
+	}
+}
+
+func TestCanStore(t *testing.T) {
+	cases := []struct {
+		name        string
+		reqCC       cacheControl
+		respCC      cacheControl
+		statusCode  int
+		sharedCache bool
+		hasExpires  bool
+		want        bool
+	}{
+		{
+			name:       "response no-store blocks storage",
+			respCC:     cacheControl{"no-store": ""},
+			statusCode: http.StatusOK,
+			want:       false,
+		},
+		{
+			name:       "request no-store blocks storage",
+			reqCC:      cacheControl{"no-store": ""},
+			statusCode: http.StatusOK,
+			want:       false,
+		},
+		{
+			name:        "bare private blocks storage in shared caches",
+			respCC:      cacheControl{"private": ""},
+			statusCode:  http.StatusOK,
+			sharedCache: true,
+			want:        false,
+		},
+		{
+			name:        "bare private is fine for private caches",
+			respCC:      cacheControl{"private": ""},
+			statusCode:  http.StatusOK,
+			sharedCache: false,
+			want:        true,
+		},
+		{
+			name:       "cacheable-by-default status code without freshness info can be stored",
+			respCC:     cacheControl{},
+			statusCode: http.StatusNotFound,
+			want:       true,
+		},
+		{
+			name:       "non-cacheable-by-default status code without freshness info is refused",
+			respCC:     cacheControl{},
+			statusCode: http.StatusAccepted,
+			want:       false,
+		},
+		{
+			name:       "explicit max-age allows storing any status code",
+			respCC:     cacheControl{"max-age": "60"},
+			statusCode: http.StatusAccepted,
+			want:       true,
+		},
+		{
+			name:       "Expires header allows storing any status code",
+			hasExpires: true,
+			respCC:     cacheControl{},
+			statusCode: http.StatusAccepted,
+			want:       true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.reqCC == nil {
+				tc.reqCC = cacheControl{}
+			}
+			if tc.respCC == nil {
+				tc.respCC = cacheControl{}
+			}
+			got := canStore(tc.reqCC, tc.respCC, tc.statusCode, tc.sharedCache, tc.hasExpires)
+			if got != tc.want {
+				t.Errorf("canStore() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseCacheControlQuotedFieldList(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		want   cacheControl
+	}{
+		{
+			name:   "single-field no-cache list",
+			header: `no-cache="set-cookie", max-age=60`,
+			want:   cacheControl{"no-cache": `"set-cookie"`, "max-age": "60"},
+		},
+		{
+			name:   "multi-field no-cache list stays together",
+			header: `no-cache="set-cookie, x-per-user-token", max-age=60`,
+			want:   cacheControl{"no-cache": `"set-cookie, x-per-user-token"`, "max-age": "60"},
+		},
+		{
+			name:   "multi-field private list stays together",
+			header: `private="set-cookie, x-per-user-token"`,
+			want:   cacheControl{"private": `"set-cookie, x-per-user-token"`},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseCacheControl(http.Header{"Cache-Control": {tc.header}})
+			if len(got) != len(tc.want) {
+				t.Fatalf("parseCacheControl(%q) = %#v, want %#v", tc.header, got, tc.want)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("parseCacheControl(%q)[%q] = %q, want %q", tc.header, k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestStripPrivateCacheFieldsHandlesMultiFieldList(t *testing.T) {
+	header := http.Header{
+		"Cache-Control":    {`private="set-cookie, x-per-user-token"`},
+		"Set-Cookie":       {"session=abc"},
+		"X-Per-User-Token": {"xyz"},
+		"Content-Type":     {"text/plain"},
+	}
+
+	stripPrivateCacheFields(header, true)
+
+	if header.Get("Set-Cookie") != "" {
+		t.Errorf("expected Set-Cookie to be stripped, got %q", header.Get("Set-Cookie"))
+	}
+	if header.Get("X-Per-User-Token") != "" {
+		t.Errorf("expected X-Per-User-Token to be stripped, got %q", header.Get("X-Per-User-Token"))
+	}
+	if header.Get("Content-Type") != "text/plain" {
+		t.Errorf("expected unrelated headers to survive, got %q", header.Get("Content-Type"))
+	}
+}
@@ -1,14 +1,18 @@
 // Package httpcache provides a http.RoundTripper implementation that works as a
 // mostly RFC-compliant cache for http responses.
 //
-// It is only suitable for use as a 'private' cache (i.e. for a web-browser or an API-client
-// and not for a shared proxy).
-//
+// By default it behaves as a 'private' cache (i.e. for a web-browser or an API-client).
+// Set Transport.SharedCache to true to opt into shared (proxy) cache semantics, which
+// additionally honors s-maxage and proxy-revalidate, refuses to store responses marked with
+// a bare private directive, and strips the fields named in a private field list from cached
+// responses before they are served. Fields named in a no-cache field list are stripped in
+// either mode.
 package httpcache
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -16,6 +20,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +31,9 @@ const (
 	stale = iota
 	fresh
 	transparent
+	// staleWhileRevalidate indicates the response is stale but within its stale-while-revalidate
+	// window (RFC 5861 §3), so it may be served immediately while a background refresh runs.
+	staleWhileRevalidate
 	// XFromCache is the header added to responses that are returned from the cache
 	XFromCache         = "X-From-Cache"
 	rangeSeparator     = "-"
@@ -49,81 +57,100 @@ type Cache interface {
 	Delete(key string)
 }
 
-// cacheKey returns the cache key for req.
+// cacheKey returns the default cache key for req: its URL, ignoring method and any Vary
+// headers. It is the default value of Transport.KeyFunc.
 func cacheKey(req *http.Request) string {
 	return req.URL.String()
 }
 
+// varySuffix returns the portion of a cache key derived from req's values for the headers
+// named in varyHeaders, so that requests differing only in those headers don't collide.
+// The headers are sorted so the suffix is stable regardless of Vary's header order.
+func varySuffix(req *http.Request, varyHeaders []string) string {
+	if len(varyHeaders) == 0 {
+		return ""
+	}
+	sorted := append([]string(nil), varyHeaders...)
+	sort.Strings(sorted)
+	var b strings.Builder
+	for _, header := range sorted {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if header == "" {
+			continue
+		}
+		b.WriteString("\x00")
+		b.WriteString(header)
+		b.WriteString("=")
+		b.WriteString(req.Header.Get(header))
+	}
+	return b.String()
+}
+
+// CanonicalKey returns the cache key for req when the cached resource's Vary header lists
+// varyHeaders: the default URL-based key with the request's values for those headers folded
+// in. This lets a Cache implementation reconstruct the key for any variant of a URL it knows
+// the Vary headers for, in order to list or evict every variant.
+func CanonicalKey(req *http.Request, varyHeaders []string) string {
+	return cacheKey(req) + varySuffix(req, varyHeaders)
+}
+
+// varyIndexSuffix is appended to a resource's base cache key to store the list of header
+// names its most recently cached response varied on, so a later request can compute the key
+// of the matching variant before it has fetched that variant's headers.
+const varyIndexSuffix = "\x00vary-index"
+
+// variantsIndexSuffix is appended to a resource's base cache key to store the suffixes of
+// every variant of it currently cached, so that invalidating the resource can remove all of
+// them instead of only the one its most recent Vary header described.
+const variantsIndexSuffix = "\x00variants"
+
 // CachedResponse returns the cached http.Response for req if present, and nil
 // otherwise.
 func CachedResponse(c Cache, req *http.Request) (resp *http.Response, err error) {
-	cachedVal, ok := c.Get(cacheKey(req))
-	if !ok {
-		return
+	// Only the default URL key is looked up: an entry a Transport stored under a KeyFunc,
+	// MethodInKey or Vary-derived key is not found here.
+	return cachedResponseForKey(c, cacheKey(req), req)
+}
+
+// cachedResponseForKey returns the cached http.Response stored under key, if present. If req
+// carries a Range header, the returned response is rewritten to satisfy it per RFC 7233 (see
+// serveRangeFromCache). When c implements StreamingCache, the entry is read through NewReader
+// instead of Get. Either way, the body is read fully into memory here so that a Range
+// request can be served from it.
+func cachedResponseForKey(c Cache, key string, req *http.Request) (resp *http.Response, err error) {
+	var raw io.Reader
+	if sc, ok := c.(StreamingCache); ok {
+		rc, _, err := sc.NewReader(key)
+		if err == ErrCacheMiss {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error loading response from cache: %s\n", err.Error())
+		}
+		defer rc.Close()
+		raw = rc
+	} else {
+		cachedVal, ok := c.Get(key)
+		if !ok {
+			return
+		}
+		raw = bytes.NewBuffer(cachedVal)
 	}
 
-	b := bytes.NewBuffer(cachedVal)
-	returnResponse, err := http.ReadResponse(bufio.NewReader(b), req)
+	returnResponse, err := http.ReadResponse(bufio.NewReader(raw), req)
 	if err != nil {
 		return nil, fmt.Errorf("error loading response from cache: %s\n", err.Error())
 	}
 
-	rangeRaw := req.Header.Get("range")
-	if rangeRaw != "" {
-		tmp := strings.Split(rangeRaw, rangeTypeSeparator)
-		// standard format is bytes=START-END
-		rangeType, rangeValue := tmp[0], tmp[1]
-		if rangeType != "bytes" {
-			logger.Print("range type %s not supported", rangeType)
-			return returnResponse, nil
-		}
-		// TODO(uovobw): handle comma-separated list of ranges
-		// in this case we simply split it and only handle the first range provided
-		if strings.Contains(tmp[1], ",") {
-			requestedRanges := strings.Split(tmp[1], ",")
-			logger.Printf("unsupported multiple ranges %s, only fulfilling %s", tmp[1], requestedRanges[0])
-			rangeValue = requestedRanges[0]
-		}
-		// we need to read all the body now, close it, and replace it with another reader
-		// as there is currently no way of "resetting" a Body
-		body, err := ioutil.ReadAll(returnResponse.Body)
-		if err != nil {
-			logger.Print("error reading cached response body: %s", err.Error())
-			return returnResponse, nil
-		}
-		returnResponse.Body.Close()
-		var rangeRequestStart, rangeRequestEnd int64
-		rangeList := strings.Split(rangeValue, rangeSeparator)
-		// the range is in the form -VAL , the wanted range is (end-val)->end
-		if strings.HasPrefix(rangeValue, rangeSeparator) {
-			rangeRequestEnd = int64(len(body))
-			end, err := strconv.ParseInt(rangeList[1], 10, 64)
-			if err != nil {
-				logger.Printf("error parsing range header %s: %s", rangeList[1], err.Error())
-				return nil, err
-			}
-			rangeRequestStart = rangeRequestEnd - end
-			// the rang is in the form VAL-, the wanted range is val->end
-		} else if strings.HasSuffix(rangeValue, rangeSeparator) {
-			rangeRequestStart, err = strconv.ParseInt(rangeList[0], 10, 64)
-			if err != nil {
-				logger.Printf("error parsing range header %s: %s", rangeList[1], err.Error())
-				return nil, err
-			}
-			rangeRequestEnd = int64(len(body))
-			// normal case with START-END
-		} else {
-			rangeRequestStart, _ = strconv.ParseInt(rangeList[0], 10, 64)
-			rangeRequestEnd, _ = strconv.ParseInt(rangeList[1], 10, 64)
-		}
-
-		if rangeRequestStart >= rangeRequestEnd {
-			logger.Printf("received non valid ranges start %d end %d", rangeRequestStart, rangeRequestEnd)
-			return nil, fmt.Errorf("non valid ranges specified in range request")
-		}
-		returnResponse.Body = ioutil.NopCloser(bytes.NewReader(body[rangeRequestStart:rangeRequestEnd]))
+	// we need to read all the body now, close it, and replace it with another reader
+	// as there is currently no way of "resetting" a Body
+	body, err := ioutil.ReadAll(returnResponse.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cached response body: %s", err.Error())
 	}
-	return returnResponse, nil
+	returnResponse.Body.Close()
+
+	return serveRangeFromCache(returnResponse, req, body)
 }
 
 // MemoryCache is an implemtation of Cache that stores responses in an in-memory map.
@@ -170,6 +197,99 @@ type Transport struct {
 	Cache     Cache
 	// If true, responses returned from the cache will be given an extra header, X-From-Cache
 	MarkCachedResponses bool
+	// SharedCache indicates that this Transport is acting as a shared (proxy) cache rather than
+	// a private one. When true, s-maxage and proxy-revalidate are honored, responses with a
+	// bare private directive aren't stored, and private field lists are stripped from cached
+	// responses before they are served. no-cache field lists are stripped either way.
+	SharedCache bool
+	// HeuristicFreshnessCap bounds the lifetime assigned to a response by heuristic freshness
+	// calculation (RFC 7234 §4.2.2) when neither max-age nor Expires is present. Defaults to
+	// defaultHeuristicFreshnessCap when zero.
+	HeuristicFreshnessCap time.Duration
+	// KeyFunc computes the cache key for a request, before any Vary-derived suffix is
+	// applied. Defaults to cacheKey (the request's URL) when nil.
+	KeyFunc func(*http.Request) string
+	// MethodInKey includes the request method in the cache key, so that, for example, a
+	// GET and a HEAD for the same URL are cached independently.
+	MethodInKey bool
+	// RevalidateInBackground enables RFC 5861 stale-while-revalidate handling: when a cached
+	// response carries a stale-while-revalidate directive and is within that window, it is
+	// served immediately and a background goroutine refreshes the cache. When false, a
+	// stale-while-revalidate response is revalidated synchronously like any other stale one.
+	RevalidateInBackground bool
+
+	// revalidateGroup coordinates background revalidations so that concurrent RoundTrips for
+	// the same key only trigger one origin fetch. Its zero value is ready to use.
+	revalidateGroup singleflightGroup
+	// fetchGroup coordinates cache misses so that concurrent RoundTrips for the same key,
+	// racing to fetch a cold URL, only trigger one origin fetch between them. Its zero value
+	// is ready to use.
+	fetchGroup singleflightGroup
+
+	// Admit, if set, is consulted after a response has otherwise passed canStore: returning
+	// false lets callers cheaply block caching by URL pattern, status code, or content-type
+	// without wrapping Cache.
+	Admit func(*http.Request, *http.Response) bool
+	// OnEvict, if set, is called whenever Transport removes or refuses a cache entry, along
+	// with the reason. It must not block for long, since it runs inline with the RoundTrip
+	// (or background revalidation) that triggered the eviction.
+	OnEvict func(key string, reason EvictReason)
+	// MaxBodyBytes, if positive, skips caching any response whose raw size (headers and body)
+	// exceeds it. Content-Length is used to reject oversized responses before they're read when
+	// available; otherwise the size is enforced as the response streams to the cache.
+	MaxBodyBytes int64
+}
+
+// EvictReason identifies why Transport removed or refused to store a cache entry, passed to
+// Transport.OnEvict.
+type EvictReason int
+
+const (
+	// EvictReasonNotCacheable indicates the response failed canStore (e.g. a no-store
+	// directive, or no freshness information for a non-heuristically-cacheable status code).
+	EvictReasonNotCacheable EvictReason = iota
+	// EvictReasonRejectedByAdmit indicates Transport.Admit returned false for the response.
+	EvictReasonRejectedByAdmit
+	// EvictReasonTooLarge indicates the response's raw size exceeded Transport.MaxBodyBytes.
+	EvictReasonTooLarge
+	// EvictReasonInvalidated indicates the entry was removed because an unsafe request method
+	// (e.g. POST, PUT, DELETE) targeted the same resource, per RFC 7234 §4.4.
+	EvictReasonInvalidated
+	// EvictReasonRevalidationFailed indicates a conditional revalidation came back with an
+	// error or an unexpected status, so the stale entry could no longer be trusted.
+	EvictReasonRevalidationFailed
+)
+
+// onEvict calls t.OnEvict for key and reason, if a callback is configured.
+func (t *Transport) onEvict(key string, reason EvictReason) {
+	if t.OnEvict != nil {
+		t.OnEvict(key, reason)
+	}
+}
+
+// defaultHeuristicFreshnessCap is the ceiling applied to heuristically-calculated freshness
+// lifetimes when Transport.HeuristicFreshnessCap isn't set.
+const defaultHeuristicFreshnessCap = 24 * time.Hour
+
+// heuristicFreshnessFraction is the fraction of (Date - Last-Modified) used as the heuristic
+// freshness lifetime, per the example given in RFC 7234 §4.2.2.
+const heuristicFreshnessFraction = 0.1
+
+// DefaultCacheableStatusCodes lists the status codes that MAY be stored and used to satisfy
+// subsequent requests even without explicit freshness information, per RFC 7234 §3 and §4.2.2.
+// It's exported so callers can add or remove status codes; changes apply package-wide.
+var DefaultCacheableStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+	http.StatusPartialContent:       true,
 }
 
 // NewTransport returns a new Transport with the
@@ -184,6 +304,84 @@ func (t *Transport) SetLogging(out io.Writer, prefix string, flags int) {
 	logger = log.New(out, prefix, flags)
 }
 
+// heuristicFreshnessCap returns t.HeuristicFreshnessCap, or defaultHeuristicFreshnessCap
+// when it isn't set.
+func (t *Transport) heuristicFreshnessCap() time.Duration {
+	if t.HeuristicFreshnessCap > 0 {
+		return t.HeuristicFreshnessCap
+	}
+	return defaultHeuristicFreshnessCap
+}
+
+// baseCacheKey returns req's cache key before any Vary-derived suffix is applied, honoring
+// KeyFunc and MethodInKey.
+func (t *Transport) baseCacheKey(req *http.Request) string {
+	keyFunc := t.KeyFunc
+	if keyFunc == nil {
+		keyFunc = cacheKey
+	}
+	key := keyFunc(req)
+	if t.MethodInKey {
+		key = req.Method + " " + key
+	}
+	return key
+}
+
+// varyHeaders returns the Vary header names most recently stored for the resource at
+// baseKey, or nil if none are on record.
+func (t *Transport) varyHeaders(baseKey string) []string {
+	raw, ok := t.Cache.Get(baseKey + varyIndexSuffix)
+	if !ok || len(raw) == 0 {
+		return nil
+	}
+	return strings.Split(string(raw), ",")
+}
+
+// setVaryHeaders records varyHeaders as the Vary header names for the resource at baseKey.
+func (t *Transport) setVaryHeaders(baseKey string, varyHeaders []string) {
+	if len(varyHeaders) == 0 {
+		t.Cache.Delete(baseKey + varyIndexSuffix)
+		return
+	}
+	t.Cache.Set(baseKey+varyIndexSuffix, []byte(strings.Join(varyHeaders, ",")))
+}
+
+// knownVariantSuffixes returns the varySuffix of every variant of baseKey that's currently
+// recorded in the cache, so invalidate can remove all of them rather than only the one
+// matching the most recently stored Vary header set.
+func (t *Transport) knownVariantSuffixes(baseKey string) []string {
+	raw, ok := t.Cache.Get(baseKey + variantsIndexSuffix)
+	if !ok || len(raw) == 0 {
+		return nil
+	}
+	return strings.Split(string(raw), "\x1f")
+}
+
+// recordVariantSuffix adds suffix, as returned by varySuffix for the response just stored, to
+// the set of variant suffixes known for baseKey.
+func (t *Transport) recordVariantSuffix(baseKey, suffix string) {
+	for _, known := range t.knownVariantSuffixes(baseKey) {
+		if known == suffix {
+			return
+		}
+	}
+	all := append(t.knownVariantSuffixes(baseKey), suffix)
+	t.Cache.Set(baseKey+variantsIndexSuffix, []byte(strings.Join(all, "\x1f")))
+}
+
+// invalidate removes every cache entry we know about for the resource at baseKey: the
+// unvaried entry, every Vary variant recorded in the variants index, and the Vary and
+// variants indexes themselves.
+func (t *Transport) invalidate(req *http.Request, baseKey string) {
+	t.Cache.Delete(baseKey)
+	for _, suffix := range t.knownVariantSuffixes(baseKey) {
+		t.Cache.Delete(baseKey + suffix)
+	}
+	t.Cache.Delete(baseKey + varyIndexSuffix)
+	t.Cache.Delete(baseKey + variantsIndexSuffix)
+	t.onEvict(baseKey, EvictReasonInvalidated)
+}
+
 // Client returns an *http.Client that caches responses.
 func (t *Transport) Client() *http.Client {
 	return &http.Client{Transport: t}
@@ -211,14 +409,16 @@ func varyMatches(cachedResp *http.Response, req *http.Request) bool {
 // will be returned.
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	req = cloneRequest(req)
-	cacheKey := cacheKey(req)
+	baseKey := t.baseCacheKey(req)
 	cacheableMethod := req.Method == "GET" || req.Method == "HEAD"
 	var cachedResp *http.Response
+	var cacheKey string
 	if cacheableMethod {
-		cachedResp, err = CachedResponse(t.Cache, req)
+		cacheKey = baseKey + varySuffix(req, t.varyHeaders(baseKey))
+		cachedResp, err = cachedResponseForKey(t.Cache, cacheKey, req)
 	} else {
 		// Need to invalidate an existing value
-		t.Cache.Delete(cacheKey)
+		t.invalidate(req, baseKey)
 	}
 
 	transport := t.Transport
@@ -235,14 +435,30 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 			cachedResp.Header.Set(XFromCache, "1")
 		}
 
+		// freshness defaults to transparent, matching the behaviour when the cached value's
+		// Vary-relevant headers don't match this request: fetch from the origin without
+		// attaching conditional validators, and don't consider it for stale-while-revalidate
+		// or stale-if-error below.
+		freshness := transparent
 		if varyMatches(cachedResp, req) {
 			// Can only use cached value if the new request doesn't Vary significantly
-			freshness := getFreshness(cachedResp.Header, req.Header)
+			freshness = getFreshness(cachedResp.Header, req.Header, cachedResp.StatusCode, t.SharedCache, t.heuristicFreshnessCap())
 			if freshness == fresh {
+				stripPrivateCacheFields(cachedResp.Header, t.SharedCache)
+				return cachedResp, nil
+			}
+
+			if freshness == staleWhileRevalidate && t.RevalidateInBackground {
+				stripPrivateCacheFields(cachedResp.Header, t.SharedCache)
+				date, _ := Date(cachedResp.Header)
+				age := currentAge(cachedResp.Header, date, clock.now())
+				cachedResp.Header.Set("Age", strconv.Itoa(int(age.Seconds())))
+				cachedResp.Header.Set("Warning", `110 - "Response is Stale"`)
+				t.triggerBackgroundRevalidate(baseKey, cacheKey, req, cachedResp)
 				return cachedResp, nil
 			}
 
-			if freshness == stale {
+			if freshness == stale || freshness == staleWhileRevalidate {
 				// Add validators if caller hasn't already done so
 				etag := cachedResp.Header.Get("etag")
 				if etag != "" && req.Header.Get("etag") == "" {
@@ -267,8 +483,14 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 
 			resp = cachedResp
 		} else {
+			if freshness != transparent && (err != nil || resp.StatusCode >= http.StatusInternalServerError) &&
+				staleIfErrorApplies(cachedResp.Header, cachedResp.StatusCode, t.SharedCache, t.heuristicFreshnessCap()) {
+				stripPrivateCacheFields(cachedResp.Header, t.SharedCache)
+				return cachedResp, nil
+			}
 			if err != nil || resp.StatusCode != http.StatusOK {
 				t.Cache.Delete(cacheKey)
+				t.onEvict(cacheKey, EvictReasonRevalidationFailed)
 			}
 			if err != nil {
 				return nil, err
@@ -279,35 +501,282 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		if _, ok := reqCacheControl["only-if-cached"]; ok {
 			resp = newGatewayTimeoutResponse(req)
 		} else {
-			resp, err = transport.RoundTrip(req)
+			// A cold miss: coalesce with any other RoundTrip racing to fetch the same key,
+			// so at most one request reaches the origin. fetchAndStore stores the result
+			// itself, so skip the generic store below.
+			resp, err = t.fetchAndStore(baseKey, cacheKey, req, transport)
 			if err != nil {
 				return nil, err
 			}
+			return resp, nil
 		}
 	}
 
+	t.storeOrInvalidate(req, resp, baseKey, cacheKey)
+	return resp, nil
+}
+
+// storeOrInvalidate stores resp in the cache under the variant key derived from baseKey and
+// req's Vary-relevant headers if it is cacheable, or deletes the entry at cacheKey otherwise.
+// When the Cache implements StreamingCache, resp.Body is wrapped so the response streams to
+// storage as it's read rather than being buffered into memory up front; the caller is
+// responsible for actually reading (and closing) resp.Body afterwards to drive that write.
+func (t *Transport) storeOrInvalidate(req *http.Request, resp *http.Response, baseKey, cacheKey string) {
 	reqCacheControl := parseCacheControl(req.Header)
 	respCacheControl := parseCacheControl(resp.Header)
+	hasExpires := resp.Header.Get("Expires") != ""
 
-	if canStore(reqCacheControl, respCacheControl) {
-		for _, varyKey := range headerAllCommaSepValues(resp.Header, "vary") {
-			varyKey = http.CanonicalHeaderKey(varyKey)
-			fakeHeader := "X-Varied-" + varyKey
-			reqValue := req.Header.Get(varyKey)
-			if reqValue != "" {
-				resp.Header.Set(fakeHeader, reqValue)
-			}
+	if !canStore(reqCacheControl, respCacheControl, resp.StatusCode, t.SharedCache, hasExpires) {
+		t.Cache.Delete(cacheKey)
+		t.onEvict(cacheKey, EvictReasonNotCacheable)
+		return
+	}
+
+	if t.Admit != nil && !t.Admit(req, resp) {
+		t.Cache.Delete(cacheKey)
+		t.onEvict(cacheKey, EvictReasonRejectedByAdmit)
+		return
+	}
+
+	respVary := headerAllCommaSepValues(resp.Header, "vary")
+	for _, varyKey := range respVary {
+		varyKey = http.CanonicalHeaderKey(varyKey)
+		fakeHeader := "X-Varied-" + varyKey
+		if reqValue := req.Header.Get(varyKey); reqValue != "" {
+			resp.Header.Set(fakeHeader, reqValue)
 		}
-		respBytes, err := httputil.DumpResponse(resp, true)
-		if err == nil {
-			t.Cache.Set(cacheKey, respBytes)
+	}
+	// Record which headers this variant was selected by, then store it under its own
+	// key so other variants of the same URL already in the cache aren't overwritten.
+	t.setVaryHeaders(baseKey, respVary)
+	variantSuffix := varySuffix(req, respVary)
+	t.recordVariantSuffix(baseKey, variantSuffix)
+	variantKey := baseKey + variantSuffix
+
+	if t.MaxBodyBytes > 0 && resp.ContentLength > t.MaxBodyBytes {
+		t.Cache.Delete(variantKey)
+		t.onEvict(variantKey, EvictReasonTooLarge)
+		return
+	}
+
+	if sc, ok := t.Cache.(StreamingCache); ok {
+		if err := t.streamToCache(sc, resp, variantKey); err != nil {
+			logger.Printf("error streaming response to cache for %s: %s", variantKey, err.Error())
+		}
+		return
+	}
+
+	if respBytes, err := httputil.DumpResponse(resp, true); err == nil {
+		if t.MaxBodyBytes > 0 && int64(len(respBytes)) > t.MaxBodyBytes {
+			t.Cache.Delete(variantKey)
+			t.onEvict(variantKey, EvictReasonTooLarge)
+			return
 		}
+		t.Cache.Set(variantKey, respBytes)
+	}
+}
+
+// streamToCache writes resp's status line and headers to sc immediately, then wraps resp.Body
+// in a TeeReadCloser so the rest of the raw response streams to the cache as resp's body is
+// read, instead of being buffered into memory up front. If Transport.MaxBodyBytes is set and
+// Content-Length didn't already rule the response out, the write is wrapped so that exceeding
+// the limit as bytes stream through aborts the commit instead of storing a truncated entry.
+func (t *Transport) streamToCache(sc StreamingCache, resp *http.Response, key string) error {
+	w, err := sc.NewWriter(key)
+	if err != nil {
+		return err
+	}
+	if t.MaxBodyBytes > 0 {
+		w = &limitWriteCloser{w: w, limit: t.MaxBodyBytes, onExceeded: func() {
+			t.Cache.Delete(key)
+			t.onEvict(key, EvictReasonTooLarge)
+		}}
+	}
+	headerResp := *resp
+	// DumpResponse writes Transfer-Encoding straight from this field, but what actually gets
+	// stored below is resp.Body's already-decoded bytes, not re-chunked ones - keeping
+	// "chunked" in the stored header would make a later NewReader misparse a perfectly good
+	// entry as truncated. Dropping it leaves neither Content-Length nor Transfer-Encoding set,
+	// so http.ReadResponse correctly reads the stored body until the entry's own EOF instead.
+	headerResp.TransferEncoding = nil
+	headerBytes, err := httputil.DumpResponse(&headerResp, false)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	if _, err := w.Write(headerBytes); err != nil {
+		w.Abort()
+		return err
+	}
+	resp.Body = NewTeeReadCloser(resp.Body, w)
+	return nil
+}
+
+// limitWriteCloser wraps w so that a write which would push the total past limit fails instead
+// of being stored, calling onExceeded (if set) the first time that happens. A TeeReadCloser
+// committing through it therefore calls Abort rather than Close, releasing w's resources
+// instead of storing a response over the limit.
+type limitWriteCloser struct {
+	w          CacheWriter
+	limit      int64
+	written    int64
+	onExceeded func()
+}
+
+func (l *limitWriteCloser) Write(p []byte) (int, error) {
+	if l.written+int64(len(p)) > l.limit {
+		if l.onExceeded != nil {
+			l.onExceeded()
+			l.onExceeded = nil
+		}
+		return 0, fmt.Errorf("httpcache: response exceeds MaxBodyBytes (%d)", l.limit)
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
+
+func (l *limitWriteCloser) Close() error {
+	return l.w.Close()
+}
+
+func (l *limitWriteCloser) Abort() error {
+	return l.w.Abort()
+}
+
+// fetchAndStore performs an upstream RoundTrip for a cache miss and stores the result,
+// coalescing concurrent misses for the same cacheKey through t.fetchGroup so only one request
+// reaches the origin no matter how many callers race the same cold URL.
+//
+// When no other RoundTrip is already fetching cacheKey, this caller becomes the leader and
+// streams the response straight through: to its own caller and, via storeOrInvalidate's usual
+// StreamingCache path, to the cache, exactly like the revalidation paths - no buffering, so
+// memory use stays bounded regardless of body size. A follower - one that joined while the
+// leader was still fetching - waits until the leader's cache write has actually committed (not
+// just until RoundTrip returns headers: for a StreamingCache response that write only finishes
+// once the leader's body has been fully read, via TeeReadCloser), then reads back whatever the
+// leader stored. If that's not a usable entry - the leader's response wasn't cacheable, or the
+// write was aborted partway through - the follower falls back to its own independent fetch
+// rather than wait indefinitely. A follower served from the cache gets its body through
+// cachedResponseForKey, which reads it into memory; a follower's own fallback fetch is
+// returned as is and is not stored.
+func (t *Transport) fetchAndStore(baseKey, cacheKey string, req *http.Request, transport http.RoundTripper) (*http.Response, error) {
+	done, isLeader := t.fetchGroup.join(cacheKey)
+	if !isLeader {
+		<-done
+		if cached, err := cachedResponseForKey(t.Cache, cacheKey, req); err == nil && cached != nil {
+			return cached, nil
+		}
+		// The leader's response wasn't left in the cache (e.g. it wasn't cacheable, or was
+		// evicted immediately after). Fetch independently rather than wait forever.
+		return transport.RoundTrip(req)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.fetchGroup.leave(cacheKey, done)
+		return nil, err
+	}
+	t.storeOrInvalidate(req, resp, baseKey, cacheKey)
+	if _, streaming := resp.Body.(*TeeReadCloser); streaming {
+		// storeOrInvalidate's write isn't done yet: it only commits once this body is read to
+		// EOF and closed. Hold followers until then instead of releasing them the moment this
+		// RoundTrip returns, or they'd wake up to an entry that isn't there yet and fetch
+		// independently - defeating the coalescing this function exists to provide.
+		resp.Body = &leaveOnClose{ReadCloser: resp.Body, leave: func() { t.fetchGroup.leave(cacheKey, done) }}
 	} else {
-		t.Cache.Delete(cacheKey)
+		t.fetchGroup.leave(cacheKey, done)
 	}
 	return resp, nil
 }
 
+// leaveOnClose defers releasing a fetchGroup leader until its response body is closed, rather
+// than as soon as fetchAndStore returns. leave is called exactly once, on the first Close, even
+// if the caller closes more than once.
+type leaveOnClose struct {
+	io.ReadCloser
+	once  sync.Once
+	leave func()
+}
+
+func (l *leaveOnClose) Close() error {
+	err := l.ReadCloser.Close()
+	l.once.Do(l.leave)
+	return err
+}
+
+// triggerBackgroundRevalidate starts an asynchronous conditional GET for the resource cached
+// at key, so a stale-while-revalidate response can be refreshed after being served. Concurrent
+// triggers for the same key are coalesced through t.revalidateGroup so only one origin fetch
+// happens at a time.
+func (t *Transport) triggerBackgroundRevalidate(baseKey, key string, req *http.Request, cachedResp *http.Response) {
+	// Detach from the client request's context: it may be canceled as soon as the client
+	// finishes reading the response we just served, which must not abort the refresh.
+	revalReq := cloneRequest(req).WithContext(context.Background())
+	if etag := cachedResp.Header.Get("etag"); etag != "" {
+		revalReq.Header.Set("if-none-match", etag)
+	}
+	if lastModified := cachedResp.Header.Get("last-modified"); lastModified != "" {
+		revalReq.Header.Set("if-modified-since", lastModified)
+	}
+
+	go func() {
+		t.revalidateGroup.Do(key, func() (interface{}, error) {
+			t.revalidate(baseKey, key, revalReq)
+			return nil, nil
+		})
+	}()
+}
+
+// revalidate performs a conditional GET for the resource cached at key and updates the cache
+// with the result: on 304 Not Modified it merges the new end-to-end headers into the
+// previously cached entry, otherwise it stores the new response as usual.
+func (t *Transport) revalidate(baseKey, key string, req *http.Request) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		logger.Printf("background revalidation of %s failed: %s", key, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotModified {
+		t.storeOrInvalidate(req, resp, baseKey, key)
+		// Nobody else reads this body: drain and close it so a StreamingCache write commits.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return
+	}
+
+	cachedVal, ok := t.Cache.Get(key)
+	if !ok {
+		return
+	}
+	cached, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(cachedVal)), req)
+	if err != nil {
+		logger.Printf("error loading cached response for %s during background revalidation: %s", key, err.Error())
+		return
+	}
+	body, err := ioutil.ReadAll(cached.Body)
+	cached.Body.Close()
+	if err != nil {
+		logger.Printf("error reading cached response body for %s during background revalidation: %s", key, err.Error())
+		return
+	}
+
+	for _, header := range getEndToEndHeaders(resp.Header) {
+		cached.Header[header] = resp.Header[header]
+	}
+	cached.Body = ioutil.NopCloser(bytes.NewReader(body))
+	t.storeOrInvalidate(req, cached, baseKey, key)
+	io.Copy(ioutil.Discard, cached.Body)
+	cached.Body.Close()
+}
+
 // ErrNoDateHeader indicates that the HTTP headers contained no Date header.
 var ErrNoDateHeader = errors.New("no Date header")
 
@@ -328,12 +797,100 @@ func (c *realClock) since(d time.Time) time.Duration {
 	return time.Since(d)
 }
 
+func (c *realClock) now() time.Time {
+	return time.Now()
+}
+
 type timer interface {
 	since(d time.Time) time.Duration
+	now() time.Time
 }
 
 var clock timer = &realClock{}
 
+// ageHeaderDuration parses the Age response header (RFC 7234 §5.1), defaulting to zero
+// when the header is absent or malformed.
+func ageHeaderDuration(respHeaders http.Header) time.Duration {
+	ageHeader := respHeaders.Get("Age")
+	if ageHeader == "" {
+		return 0
+	}
+	ageSeconds, err := strconv.ParseInt(ageHeader, 10, 64)
+	if err != nil || ageSeconds < 0 {
+		return 0
+	}
+	return time.Duration(ageSeconds) * time.Second
+}
+
+// currentAge approximates a response's current_age (RFC 7234 §4.2.3) from its headers alone:
+// the larger of the apparent age (now - Date) and the Age header. Only the response's headers
+// are persisted in the cache (not the timing of the request that fetched it), so the
+// response_delay (response_time - request_time) term is omitted, and the Age header's value
+// is used as stored, without adding the time the response has since spent in the cache.
+func currentAge(respHeaders http.Header, date time.Time, now time.Time) time.Duration {
+	apparentAge := now.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	age := ageHeaderDuration(respHeaders)
+	if apparentAge > age {
+		age = apparentAge
+	}
+	return age
+}
+
+// heuristicLifetime estimates a freshness lifetime for responses that carry no explicit
+// freshness information, per the heuristic described in RFC 7234 §4.2.2: heuristicFreshnessFraction
+// of the interval between Last-Modified and Date, capped by maxLifetime. ok is false when the
+// response's status code isn't heuristically cacheable or Last-Modified is missing or unparseable.
+func heuristicLifetime(respHeaders http.Header, statusCode int, date time.Time, maxLifetime time.Duration) (lifetime time.Duration, ok bool) {
+	if !DefaultCacheableStatusCodes[statusCode] {
+		return 0, false
+	}
+	lastModifiedHeader := respHeaders.Get("Last-Modified")
+	if lastModifiedHeader == "" {
+		return 0, false
+	}
+	lastModified, err := time.Parse(time.RFC1123, lastModifiedHeader)
+	if err != nil {
+		return 0, false
+	}
+	age := date.Sub(lastModified)
+	if age <= 0 {
+		return 0, false
+	}
+	lifetime = time.Duration(float64(age) * heuristicFreshnessFraction)
+	if lifetime > maxLifetime {
+		lifetime = maxLifetime
+	}
+	return lifetime, true
+}
+
+// stripPrivateCacheFields removes the header fields named in a stored response's no-cache
+// directive (always) and its private directive (only for shared caches) before the response
+// is served from cache, per RFC 7234 §5.2.2.2 and §5.2.2.6. Bare no-cache/private (no field
+// list) are handled elsewhere: bare no-cache forces revalidation in getFreshness, and bare
+// private is refused storage entirely in canStore when sharedCache is true.
+func stripPrivateCacheFields(header http.Header, sharedCache bool) {
+	respCacheControl := parseCacheControl(header)
+	removeFields(header, respCacheControl["no-cache"])
+	if sharedCache {
+		removeFields(header, respCacheControl["private"])
+	}
+}
+
+func removeFields(header http.Header, fieldList string) {
+	fieldList = strings.Trim(fieldList, "\"")
+	if fieldList == "" {
+		return
+	}
+	for _, field := range strings.FieldsFunc(fieldList, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if field != "" {
+			header.Del(http.CanonicalHeaderKey(field))
+		}
+	}
+}
+
 // getFreshness will return one of fresh/stale/transparent based on the cache-control
 // values of the request and the response
 //
@@ -341,15 +898,22 @@ var clock timer = &realClock{}
 // stale indicates that the response needs validating before it is returned
 // transparent indicates the response should not be used to fulfil the request
 //
-// Because this is only a private cache, 'public' and 'private' in cache-control aren't
-// signficant. Similarly, smax-age isn't used.
-func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
+// statusCode and sharedCache let callers opt into RFC 7234 behaviour that only applies to
+// some responses (heuristic freshness) or only to shared caches (s-maxage, proxy-revalidate).
+// heuristicCap bounds the lifetime assigned by heuristic freshness calculation.
+//
+// It also returns staleWhileRevalidate when the response is stale but still within its
+// stale-while-revalidate window and must-revalidate (or, for shared caches, proxy-revalidate)
+// is absent.
+func getFreshness(respHeaders, reqHeaders http.Header, statusCode int, sharedCache bool, heuristicCap time.Duration) (freshness int) {
 	respCacheControl := parseCacheControl(respHeaders)
 	reqCacheControl := parseCacheControl(reqHeaders)
 	if _, ok := reqCacheControl["no-cache"]; ok {
 		return transparent
 	}
-	if _, ok := respCacheControl["no-cache"]; ok {
+	// A bare no-cache forces revalidation on every use; no-cache=field only restricts the
+	// listed fields (handled by stripPrivateCacheFields) and doesn't affect freshness.
+	if noCacheFields, ok := respCacheControl["no-cache"]; ok && noCacheFields == "" {
 		return stale
 	}
 	if _, ok := reqCacheControl["only-if-cached"]; ok {
@@ -360,27 +924,49 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	if err != nil {
 		return stale
 	}
-	currentAge := clock.since(date)
+	age := currentAge(respHeaders, date, clock.now())
 
 	var lifetime time.Duration
 	var zeroDuration time.Duration
+	haveExplicitLifetime := false
+
+	if sharedCache {
+		if sMaxAge, ok := respCacheControl["s-maxage"]; ok {
+			if d, err := time.ParseDuration(sMaxAge + "s"); err == nil {
+				lifetime = d
+				haveExplicitLifetime = true
+			}
+		}
+	}
 
 	// If a response includes both an Expires header and a max-age directive,
 	// the max-age directive overrides the Expires header, even if the Expires header is more restrictive.
-	if maxAge, ok := respCacheControl["max-age"]; ok {
-		lifetime, err = time.ParseDuration(maxAge + "s")
-		if err != nil {
-			lifetime = zeroDuration
-		}
-	} else {
-		expiresHeader := respHeaders.Get("Expires")
-		if expiresHeader != "" {
-			expires, err := time.Parse(time.RFC1123, expiresHeader)
+	if !haveExplicitLifetime {
+		if maxAge, ok := respCacheControl["max-age"]; ok {
+			lifetime, err = time.ParseDuration(maxAge + "s")
 			if err != nil {
 				lifetime = zeroDuration
-			} else {
-				lifetime = expires.Sub(date)
 			}
+			haveExplicitLifetime = true
+		} else {
+			expiresHeader := respHeaders.Get("Expires")
+			if expiresHeader != "" {
+				expires, err := time.Parse(time.RFC1123, expiresHeader)
+				if err != nil {
+					lifetime = zeroDuration
+				} else {
+					lifetime = expires.Sub(date)
+				}
+				haveExplicitLifetime = true
+			}
+		}
+	}
+
+	// Neither the response nor the request gave us explicit freshness info: fall back to
+	// heuristic freshness for status codes where that's permitted.
+	if !haveExplicitLifetime {
+		if heuristic, ok := heuristicLifetime(respHeaders, statusCode, date, heuristicCap); ok {
+			lifetime = heuristic
 		}
 	}
 
@@ -395,11 +981,20 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 		//  the client wants a response that will still be fresh for at least the specified number of seconds.
 		minfreshDuration, err := time.ParseDuration(minfresh + "s")
 		if err == nil {
-			currentAge = time.Duration(currentAge + minfreshDuration)
+			age = time.Duration(age + minfreshDuration)
+		}
+	}
+
+	// must-revalidate (and, for shared caches, proxy-revalidate) forbid serving a stale
+	// response no matter how permissive the request's max-stale is.
+	_, mustRevalidate := respCacheControl["must-revalidate"]
+	if sharedCache {
+		if _, ok := respCacheControl["proxy-revalidate"]; ok {
+			mustRevalidate = true
 		}
 	}
 
-	if maxstale, ok := reqCacheControl["max-stale"]; ok {
+	if maxstale, ok := reqCacheControl["max-stale"]; ok && !mustRevalidate {
 		// Indicates that the client is willing to accept a response that has exceeded its expiration time.
 		// If max-stale is assigned a value, then the client is willing to accept a response that has exceeded
 		// its expiration time by no more than the specified number of seconds.
@@ -413,17 +1008,103 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 		}
 		maxstaleDuration, err := time.ParseDuration(maxstale + "s")
 		if err == nil {
-			currentAge = time.Duration(currentAge - maxstaleDuration)
+			age = time.Duration(age - maxstaleDuration)
 		}
 	}
 
-	if lifetime > currentAge {
+	if lifetime > age {
 		return fresh
 	}
 
+	// must-revalidate/proxy-revalidate also invalidate stale-while-revalidate, per RFC 5861 §3.
+	if !mustRevalidate {
+		if swr, ok := staleWhileRevalidateWindow(respCacheControl); ok && age <= lifetime+swr {
+			return staleWhileRevalidate
+		}
+	}
+
 	return stale
 }
 
+// staleWhileRevalidateWindow returns the stale-while-revalidate window from a response's
+// Cache-Control, per RFC 5861 §3, and whether it was present.
+func staleWhileRevalidateWindow(respCacheControl cacheControl) (time.Duration, bool) {
+	raw, ok := respCacheControl["stale-while-revalidate"]
+	if !ok {
+		return 0, false
+	}
+	d, err := time.ParseDuration(raw + "s")
+	if err != nil {
+		return 0, false
+	}
+	return d, true
+}
+
+// staleIfErrorApplies reports whether a cached response may be served in place of an origin
+// error or 5xx response, per RFC 5861 §4: it must carry a stale-if-error directive (ignored
+// when must-revalidate/proxy-revalidate is present, same as stale-while-revalidate), and its
+// current_age must fall within its freshness lifetime plus that window.
+func staleIfErrorApplies(respHeaders http.Header, statusCode int, sharedCache bool, heuristicCap time.Duration) bool {
+	respCacheControl := parseCacheControl(respHeaders)
+	if _, ok := respCacheControl["must-revalidate"]; ok {
+		return false
+	}
+	if sharedCache {
+		if _, ok := respCacheControl["proxy-revalidate"]; ok {
+			return false
+		}
+	}
+	raw, ok := respCacheControl["stale-if-error"]
+	if !ok {
+		return false
+	}
+	sie, err := time.ParseDuration(raw + "s")
+	if err != nil {
+		return false
+	}
+
+	date, err := Date(respHeaders)
+	if err != nil {
+		return false
+	}
+	age := currentAge(respHeaders, date, clock.now())
+	lifetime := explicitOrHeuristicLifetime(respHeaders, statusCode, sharedCache, date, heuristicCap)
+	return age <= lifetime+sie
+}
+
+// explicitOrHeuristicLifetime computes a response's freshness lifetime from its own
+// Cache-Control/Expires headers (s-maxage for shared caches, then max-age, then Expires),
+// falling back to heuristic freshness (RFC 7234 §4.2.2) when none of those are present. It
+// ignores request-side overrides (max-age, min-fresh, max-stale); see getFreshness for those.
+func explicitOrHeuristicLifetime(respHeaders http.Header, statusCode int, sharedCache bool, date time.Time, heuristicCap time.Duration) time.Duration {
+	respCacheControl := parseCacheControl(respHeaders)
+	if sharedCache {
+		if sMaxAge, ok := respCacheControl["s-maxage"]; ok {
+			if d, err := time.ParseDuration(sMaxAge + "s"); err == nil {
+				return d
+			}
+		}
+	}
+	if maxAge, ok := respCacheControl["max-age"]; ok {
+		d, err := time.ParseDuration(maxAge + "s")
+		if err != nil {
+			return 0
+		}
+		return d
+	}
+	if expiresHeader := respHeaders.Get("Expires"); expiresHeader != "" {
+		expires, err := time.Parse(time.RFC1123, expiresHeader)
+		if err != nil {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if heuristic, ok := heuristicLifetime(respHeaders, statusCode, date, heuristicCap); ok {
+		return heuristic
+	}
+	return 0
+}
+
 func getEndToEndHeaders(respHeaders http.Header) []string {
 	// These headers are always hop-by-hop
 	hopByHopHeaders := map[string]struct{}{
@@ -431,10 +1112,10 @@ func getEndToEndHeaders(respHeaders http.Header) []string {
 		"Keep-Alive":          struct{}{},
 		"Proxy-Authenticate":  struct{}{},
 		"Proxy-Authorization": struct{}{},
-		"Te":                struct{}{},
-		"Trailers":          struct{}{},
-		"Transfer-Encoding": struct{}{},
-		"Upgrade":           struct{}{},
+		"Te":                  struct{}{},
+		"Trailers":            struct{}{},
+		"Transfer-Encoding":   struct{}{},
+		"Upgrade":             struct{}{},
 	}
 
 	for _, extra := range strings.Split(respHeaders.Get("connection"), ",") {
@@ -452,13 +1133,28 @@ func getEndToEndHeaders(respHeaders http.Header) []string {
 	return endToEndHeaders
 }
 
-func canStore(reqCacheControl, respCacheControl cacheControl) (canStore bool) {
+// canStore reports whether a response may be stored in the cache, per RFC 7234 §3.
+// statusCode and sharedCache let the cacheable-by-default status code table and the
+// shared-cache-only private directive apply; hasExpires indicates the response carried
+// an Expires header (counted as explicit freshness info alongside max-age/s-maxage).
+func canStore(reqCacheControl, respCacheControl cacheControl, statusCode int, sharedCache bool, hasExpires bool) (canStore bool) {
 	if _, ok := respCacheControl["no-store"]; ok {
 		return false
 	}
 	if _, ok := reqCacheControl["no-store"]; ok {
 		return false
 	}
+	if sharedCache {
+		if fields, ok := respCacheControl["private"]; ok && fields == "" {
+			return false
+		}
+	}
+	_, hasMaxAge := respCacheControl["max-age"]
+	_, hasSMaxAge := respCacheControl["s-maxage"]
+	explicitFreshness := hasMaxAge || hasSMaxAge || hasExpires
+	if !explicitFreshness && !DefaultCacheableStatusCodes[statusCode] {
+		return false
+	}
 	return true
 }
 
@@ -492,7 +1188,7 @@ type cacheControl map[string]string
 func parseCacheControl(headers http.Header) cacheControl {
 	cc := cacheControl{}
 	ccHeader := headers.Get("Cache-Control")
-	for _, part := range strings.Split(ccHeader, ",") {
+	for _, part := range splitUnquoted(ccHeader, ',') {
 		part = strings.Trim(part, " ")
 		if part == "" {
 			continue
@@ -507,6 +1203,31 @@ func parseCacheControl(headers http.Header) cacheControl {
 	return cc
 }
 
+// splitUnquoted splits s on sep like strings.Split, except a sep that falls between a pair of
+// double quotes is kept as part of the field instead of splitting it, per the quoted-string
+// syntax RFC 7230 §3.2.6 shares across header values. This matters for directives like
+// no-cache="set-cookie, x-foo" or private="set-cookie, x-foo", where RFC 7234 §5.2.2.2/§5.2.2.6
+// allow a comma-separated field list inside the quotes that must stay together.
+func splitUnquoted(s string, sep rune) []string {
+	var parts []string
+	var field strings.Builder
+	inQuotes := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			field.WriteRune(r)
+		case r == sep && !inQuotes:
+			parts = append(parts, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	parts = append(parts, field.String())
+	return parts
+}
+
 // headerAllCommaSepValues returns all comma-separated values (each
 // with whitespace trimmed) for header name in headers. According to
 // Section 4.2 of the HTTP/1.1 spec
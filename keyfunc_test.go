@@ -0,0 +1,90 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newTestRequest(method, rawurl string, headers http.Header) *http.Request {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		panic(err)
+	}
+	if headers == nil {
+		headers = http.Header{}
+	}
+	return &http.Request{Method: method, URL: u, Header: headers}
+}
+
+func TestCanonicalKey(t *testing.T) {
+	req := newTestRequest("GET", "http://example.com/", http.Header{
+		"Accept-Encoding": {"gzip"},
+		"Authorization":   {"Bearer token"},
+	})
+
+	plain := CanonicalKey(req, nil)
+	if plain != "http://example.com/" {
+		t.Errorf("CanonicalKey(nil) = %q, want plain URL", plain)
+	}
+
+	varied := CanonicalKey(req, []string{"Accept-Encoding"})
+	if varied == plain {
+		t.Errorf("CanonicalKey with Vary headers should differ from the plain URL key")
+	}
+
+	reordered := CanonicalKey(req, []string{"Authorization", "Accept-Encoding"})
+	bothOrders := CanonicalKey(req, []string{"Accept-Encoding", "Authorization"})
+	if reordered != bothOrders {
+		t.Errorf("CanonicalKey should be stable regardless of varyHeaders order: %q != %q", reordered, bothOrders)
+	}
+
+	other := newTestRequest("GET", "http://example.com/", http.Header{
+		"Accept-Encoding": {"identity"},
+	})
+	if CanonicalKey(req, []string{"Accept-Encoding"}) == CanonicalKey(other, []string{"Accept-Encoding"}) {
+		t.Errorf("requests with different varied header values should get different keys")
+	}
+}
+
+func TestTransportVaryAwareKeysDontCollide(t *testing.T) {
+	cache := NewMemoryCache()
+	transport := NewTransport(cache)
+
+	reqGzip := newTestRequest("GET", "http://example.com/", http.Header{"Accept-Encoding": {"gzip"}})
+	reqIdentity := newTestRequest("GET", "http://example.com/", http.Header{"Accept-Encoding": {"identity"}})
+
+	baseKey := transport.baseCacheKey(reqGzip)
+	transport.setVaryHeaders(baseKey, []string{"Accept-Encoding"})
+
+	gzipKey := baseKey + varySuffix(reqGzip, []string{"Accept-Encoding"})
+	identityKey := baseKey + varySuffix(reqIdentity, []string{"Accept-Encoding"})
+	if gzipKey == identityKey {
+		t.Fatalf("expected distinct keys per Vary'd representation, got %q for both", gzipKey)
+	}
+
+	cache.Set(gzipKey, []byte("gzip-variant"))
+	cache.Set(identityKey, []byte("identity-variant"))
+
+	got, _ := cache.Get(gzipKey)
+	if string(got) != "gzip-variant" {
+		t.Errorf("gzip variant overwritten, got %q", got)
+	}
+	got, _ = cache.Get(identityKey)
+	if string(got) != "identity-variant" {
+		t.Errorf("identity variant overwritten, got %q", got)
+	}
+}
+
+func TestMethodInKey(t *testing.T) {
+	cache := NewMemoryCache()
+	transport := NewTransport(cache)
+	transport.MethodInKey = true
+
+	get := newTestRequest("GET", "http://example.com/", nil)
+	head := newTestRequest("HEAD", "http://example.com/", nil)
+
+	if transport.baseCacheKey(get) == transport.baseCacheKey(head) {
+		t.Errorf("MethodInKey should make GET and HEAD keys differ")
+	}
+}
@@ -0,0 +1,197 @@
+package httpcache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteRange is an inclusive [start, end] byte range into a resource of a known size.
+type byteRange struct {
+	start, end int64
+}
+
+// parseByteRanges parses a Range header value into the list of inclusive byte ranges it
+// requests against a resource of the given size, per RFC 7233 §2.1. Ranges that fall
+// entirely outside the resource, or that can't be parsed, are dropped; if none remain, an
+// error is returned so the caller can respond with 416 Range Not Satisfiable.
+func parseByteRanges(rangeHeader string, size int64) ([]byteRange, error) {
+	const prefix = "bytes" + rangeTypeSeparator
+	if !strings.HasPrefix(rangeHeader, prefix) {
+		return nil, fmt.Errorf("unsupported range unit in %q", rangeHeader)
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(strings.TrimPrefix(rangeHeader, prefix), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.SplitN(spec, rangeSeparator, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		startRaw, endRaw := parts[0], parts[1]
+
+		var start, end int64
+		switch {
+		case startRaw == "" && endRaw != "":
+			// A suffix range "-N" requests the last N bytes of the resource.
+			suffixLength, err := strconv.ParseInt(endRaw, 10, 64)
+			if err != nil || suffixLength <= 0 {
+				continue
+			}
+			if suffixLength > size {
+				suffixLength = size
+			}
+			start, end = size-suffixLength, size-1
+		case endRaw == "":
+			parsedStart, err := strconv.ParseInt(startRaw, 10, 64)
+			if err != nil {
+				continue
+			}
+			start, end = parsedStart, size-1
+		default:
+			parsedStart, err1 := strconv.ParseInt(startRaw, 10, 64)
+			parsedEnd, err2 := strconv.ParseInt(endRaw, 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			start, end = parsedStart, parsedEnd
+			if end >= size {
+				end = size - 1
+			}
+		}
+
+		if start < 0 || end < start || start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, end: end})
+	}
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no satisfiable ranges in %q", rangeHeader)
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether req's If-Range validator (if any) matches resp. An absent
+// If-Range always matches. A quoted or weak value is compared as an ETag; anything else is
+// parsed as an HTTP-date and compared against Last-Modified, per RFC 7233 §3.2.
+func ifRangeMatches(resp *http.Response, req *http.Request) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return ifRange == resp.Header.Get("Etag")
+	}
+	ifRangeTime, err := time.Parse(time.RFC1123, ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := time.Parse(time.RFC1123, resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifRangeTime)
+}
+
+// cloneResponseHeader returns a deep copy of h so a partial response's headers can be
+// modified without mutating the cached original.
+func cloneResponseHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// serveRangeFromCache rewrites resp (whose body has already been read into memory as body)
+// to satisfy req's Range header, per RFC 7233. If req has no Range header, or its If-Range
+// validator doesn't match resp, the full response is returned unmodified (status 200). A
+// single satisfiable range yields a 206 with one Content-Range header; multiple ranges yield
+// a 206 multipart/byteranges body; no satisfiable range yields 416 Range Not Satisfiable.
+func serveRangeFromCache(resp *http.Response, req *http.Request, body []byte) (*http.Response, error) {
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" || !ifRangeMatches(resp, req) {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		return resp, nil
+	}
+
+	size := int64(len(body))
+	ranges, err := parseByteRanges(rangeHeader, size)
+	if err != nil {
+		return rangeNotSatisfiableResponse(resp, size), nil
+	}
+	if len(ranges) == 1 {
+		return singleRangeResponse(resp, body, ranges[0]), nil
+	}
+	return multiRangeResponse(resp, body, ranges)
+}
+
+func singleRangeResponse(resp *http.Response, body []byte, r byteRange) *http.Response {
+	partial := *resp
+	partial.Header = cloneResponseHeader(resp.Header)
+	partial.Body = ioutil.NopCloser(bytes.NewReader(body[r.start : r.end+1]))
+	partial.ContentLength = r.end - r.start + 1
+	partial.Header.Set("Content-Length", strconv.FormatInt(partial.ContentLength, 10))
+	partial.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, len(body)))
+	partial.Status = fmt.Sprintf("%d %s", http.StatusPartialContent, http.StatusText(http.StatusPartialContent))
+	partial.StatusCode = http.StatusPartialContent
+	return &partial
+}
+
+func multiRangeResponse(resp *http.Response, body []byte, ranges []byteRange) (*http.Response, error) {
+	contentType := resp.Header.Get("Content-Type")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, r := range ranges {
+		partHeader := make(textproto.MIMEHeader)
+		partHeader.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, len(body)))
+		if contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+		part, err := mw.CreatePart(partHeader)
+		if err != nil {
+			return nil, fmt.Errorf("error writing multipart/byteranges part: %s", err.Error())
+		}
+		if _, err := part.Write(body[r.start : r.end+1]); err != nil {
+			return nil, fmt.Errorf("error writing multipart/byteranges part: %s", err.Error())
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("error closing multipart/byteranges body: %s", err.Error())
+	}
+
+	partial := *resp
+	partial.Header = cloneResponseHeader(resp.Header)
+	partial.Header.Del("Content-Range")
+	partial.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	partial.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	partial.Body = ioutil.NopCloser(bytes.NewReader(buf.Bytes()))
+	partial.ContentLength = int64(buf.Len())
+	partial.Status = fmt.Sprintf("%d %s", http.StatusPartialContent, http.StatusText(http.StatusPartialContent))
+	partial.StatusCode = http.StatusPartialContent
+	return &partial, nil
+}
+
+func rangeNotSatisfiableResponse(resp *http.Response, size int64) *http.Response {
+	partial := *resp
+	partial.Header = cloneResponseHeader(resp.Header)
+	partial.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	partial.Header.Del("Content-Length")
+	partial.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	partial.ContentLength = 0
+	partial.Status = fmt.Sprintf("%d %s", http.StatusRequestedRangeNotSatisfiable, http.StatusText(http.StatusRequestedRangeNotSatisfiable))
+	partial.StatusCode = http.StatusRequestedRangeNotSatisfiable
+	return &partial
+}
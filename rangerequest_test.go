@@ -0,0 +1,157 @@
+package httpcache
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newRangeTestResponse(headers http.Header) *http.Response {
+	if headers == nil {
+		headers = http.Header{}
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     headers,
+	}
+}
+
+func TestServeRangeFromCache(t *testing.T) {
+	body := []byte("0123456789")
+
+	cases := []struct {
+		name        string
+		reqHeaders  http.Header
+		respHeaders http.Header
+		wantStatus  int
+		wantBody    string
+	}{
+		{
+			name:       "no range header returns full body",
+			reqHeaders: http.Header{},
+			wantStatus: http.StatusOK,
+			wantBody:   "0123456789",
+		},
+		{
+			name:       "single range",
+			reqHeaders: http.Header{"Range": {"bytes=2-5"}},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "2345",
+		},
+		{
+			name:       "suffix range within body length",
+			reqHeaders: http.Header{"Range": {"bytes=-3"}},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "789",
+		},
+		{
+			name:       "suffix range larger than body is clamped to start",
+			reqHeaders: http.Header{"Range": {"bytes=-100"}},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "0123456789",
+		},
+		{
+			name:       "open-ended range",
+			reqHeaders: http.Header{"Range": {"bytes=7-"}},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "789",
+		},
+		{
+			name:       "unsatisfiable range",
+			reqHeaders: http.Header{"Range": {"bytes=100-200"}},
+			wantStatus: http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name:        "If-Range etag mismatch falls back to full response",
+			reqHeaders:  http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"old-etag"`}},
+			respHeaders: http.Header{"Etag": {`"new-etag"`}},
+			wantStatus:  http.StatusOK,
+			wantBody:    "0123456789",
+		},
+		{
+			name:        "If-Range etag match serves the range",
+			reqHeaders:  http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"etag"`}},
+			respHeaders: http.Header{"Etag": {`"etag"`}},
+			wantStatus:  http.StatusPartialContent,
+			wantBody:    "0123",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest("GET", "http://example.com/", tc.reqHeaders)
+			resp := newRangeTestResponse(tc.respHeaders)
+
+			got, err := serveRangeFromCache(resp, req, body)
+			if err != nil {
+				t.Fatalf("serveRangeFromCache returned error: %s", err)
+			}
+			if got.StatusCode != tc.wantStatus {
+				t.Errorf("StatusCode = %d, want %d", got.StatusCode, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusPartialContent {
+				contentRange := got.Header.Get("Content-Range")
+				if contentRange == "" {
+					t.Errorf("expected Content-Range header on 206 response")
+				}
+			}
+			if tc.wantBody != "" {
+				gotBody, err := ioutil.ReadAll(got.Body)
+				if err != nil {
+					t.Fatalf("error reading response body: %s", err)
+				}
+				if string(gotBody) != tc.wantBody {
+					t.Errorf("body = %q, want %q", gotBody, tc.wantBody)
+				}
+			}
+		})
+	}
+}
+
+func TestServeRangeFromCacheMultiRange(t *testing.T) {
+	body := []byte("0123456789")
+	req := newTestRequest("GET", "http://example.com/", http.Header{
+		"Range": {"bytes=0-1,5-6"},
+	})
+	resp := newRangeTestResponse(http.Header{"Content-Type": {"text/plain"}})
+
+	got, err := serveRangeFromCache(resp, req, body)
+	if err != nil {
+		t.Fatalf("serveRangeFromCache returned error: %s", err)
+	}
+	if got.StatusCode != http.StatusPartialContent {
+		t.Fatalf("StatusCode = %d, want %d", got.StatusCode, http.StatusPartialContent)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(got.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("error parsing Content-Type: %s", err)
+	}
+	if mediaType != "multipart/byteranges" {
+		t.Errorf("Content-Type = %q, want multipart/byteranges", mediaType)
+	}
+
+	mr := multipart.NewReader(got.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("error reading part: %s", err)
+		}
+		if part.Header.Get("Content-Range") == "" {
+			t.Errorf("expected Content-Range on each part")
+		}
+		parts = append(parts, string(data))
+	}
+	if strings.Join(parts, ",") != "01,56" {
+		t.Errorf("parts = %v, want [01 56]", parts)
+	}
+}
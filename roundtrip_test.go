@@ -0,0 +1,311 @@
+package httpcache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoundTripServesStaleWhileRevalidateAndRefreshesInBackground(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		w.Header().Set("Date", time.Now().UTC().Format(time.RFC1123))
+		w.Header().Set("Etag", `"v1"`)
+		if n > 1 && r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	transport := NewTransport(NewMemoryCache())
+	transport.RevalidateInBackground = true
+	client := transport.Client()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("first request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	// Let the max-age=0 response become stale, then request again: it should be served
+	// from cache immediately (stale-while-revalidate) while a background refresh happens.
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("second request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get(XFromCache) == "" {
+		t.Errorf("expected second response to be served from cache")
+	}
+	if resp.Header.Get("Warning") == "" {
+		t.Errorf("expected a Warning header on a stale-while-revalidate response")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&hits) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&hits); got < 2 {
+		t.Errorf("expected background revalidation to hit the origin, got %d hits", got)
+	}
+}
+
+func TestRoundTripServesStaleIfErrorOnOriginFailure(t *testing.T) {
+	var fail int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		w.Header().Set("Date", time.Now().UTC().Format(time.RFC1123))
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	transport := NewTransport(NewMemoryCache())
+	client := transport.Client()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("first request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	atomic.StoreInt32(&fail, 1)
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("second request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode = %d, want %d (stale response served despite origin 500)", resp.StatusCode, http.StatusOK)
+	}
+	if resp.Header.Get(XFromCache) == "" {
+		t.Errorf("expected the stale-if-error response to be served from cache")
+	}
+}
+
+func TestRoundTripStreamsToStreamingCache(t *testing.T) {
+	const body = "hello streaming world"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	cache := newMemoryStreamingCache()
+	transport := NewTransport(cache)
+	client := transport.Client()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("first request failed: %s", err)
+	}
+	got, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("reading first response: %s", err)
+	}
+	if string(got) != body {
+		t.Errorf("first response body = %q, want %q", got, body)
+	}
+
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("second request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get(XFromCache) == "" {
+		t.Errorf("expected second response to be served from the streaming cache")
+	}
+	got, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading second response: %s", err)
+	}
+	if string(got) != body {
+		t.Errorf("second response body = %q, want %q", got, body)
+	}
+}
+
+func TestRoundTripSolitaryColdMissStreamsWithoutBuffering(t *testing.T) {
+	const body = "hello streaming world"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	cache := newMemoryStreamingCache()
+	transport := NewTransport(cache)
+	client := transport.Client()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	// Read only part of the body and abort without reaching EOF. If fetchAndStore still
+	// buffered the whole response up front (like it used to for every miss, contended or not),
+	// the cache would already hold a complete entry regardless of what the client does with
+	// the body. Streaming through TeeReadCloser only commits on a full, successful read, so an
+	// aborted read like this one must leave no entry behind.
+	partial := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, partial); err != nil {
+		t.Fatalf("partial read failed: %s", err)
+	}
+	resp.Body.Close()
+
+	if _, ok := cache.Get(transport.baseCacheKey(mustRequest(t, server.URL))); ok {
+		t.Errorf("expected no cache entry after an aborted read of a solitary cold miss")
+	}
+}
+
+func mustRequest(t *testing.T, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s", err)
+	}
+	return req
+}
+
+func TestRoundTripCoalescesConcurrentColdMisses(t *testing.T) {
+	var hits int32
+	var started sync.WaitGroup
+	const n = 10
+	started.Add(n)
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	transport := NewTransport(NewMemoryCache())
+	client := transport.Client()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Errorf("request failed: %s", err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+	}
+
+	started.Wait()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("origin was hit %d times, want 1 (concurrent cold misses should coalesce)", got)
+	}
+}
+
+func TestRoundTripCoalescesFollowerJoiningMidBodyStream(t *testing.T) {
+	var hits int32
+	firstChunkWritten := make(chan struct{})
+	releaseRest := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("first-chunk-"))
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		if n == 1 {
+			close(firstChunkWritten)
+			<-releaseRest
+		}
+		w.Write([]byte("rest-of-body"))
+	}))
+	defer server.Close()
+
+	cache := newMemoryStreamingCache()
+	transport := NewTransport(cache)
+	client := transport.Client()
+
+	const want = "first-chunk-rest-of-body"
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	var leaderBody []byte
+	var leaderErr error
+	go func() {
+		defer wg.Done()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			leaderErr = err
+			return
+		}
+		leaderBody, leaderErr = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}()
+
+	<-firstChunkWritten
+	time.Sleep(10 * time.Millisecond)
+
+	var followerBody []byte
+	var followerErr error
+	go func() {
+		defer wg.Done()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			followerErr = err
+			return
+		}
+		followerBody, followerErr = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}()
+
+	// Give the follower a chance to join the in-flight fetch while the leader's body is still
+	// streaming (the leader is blocked in the handler, headers already sent) before letting the
+	// leader's response finish.
+	time.Sleep(10 * time.Millisecond)
+	close(releaseRest)
+	wg.Wait()
+
+	if leaderErr != nil {
+		t.Fatalf("leader request failed: %s", leaderErr)
+	}
+	if followerErr != nil {
+		t.Fatalf("follower request failed: %s", followerErr)
+	}
+	if string(leaderBody) != want {
+		t.Errorf("leader body = %q, want %q", leaderBody, want)
+	}
+	if string(followerBody) != want {
+		t.Errorf("follower body = %q, want %q", followerBody, want)
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("origin was hit %d times, want 1 (follower joined while the leader's body was still streaming)", got)
+	}
+}
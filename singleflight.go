@@ -0,0 +1,75 @@
+package httpcache
+
+import "sync"
+
+// singleflightGroup coordinates duplicate concurrent calls for the same key so only one of
+// them actually runs; the others block and receive its result. Its zero value is a valid,
+// empty group (mirroring golang.org/x/sync/singleflight.Group, which this package doesn't
+// depend on to avoid pulling in an external module for a single helper).
+type singleflightGroup struct {
+	mu       sync.Mutex
+	calls    map[string]*singleflightCall
+	inflight map[string]chan struct{}
+}
+
+type singleflightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// Do calls fn for key and returns its result, unless a call for key is already in flight, in
+// which case it waits for and returns that call's result instead.
+func (g *singleflightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*singleflightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+
+	c := new(singleflightCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.val, c.err
+}
+
+// join registers the caller as working on key and reports whether it is the leader: the one
+// responsible for doing the work and, once done, calling leave to release any followers. A
+// follower (isLeader false) should wait on done instead of doing the work itself. Unlike Do,
+// join carries no result: it only tells the caller whether another caller is already working
+// on key. A leader is not told whether any followers join after it.
+func (g *singleflightGroup) join(key string) (done chan struct{}, isLeader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.inflight == nil {
+		g.inflight = make(map[string]chan struct{})
+	}
+	if ch, ok := g.inflight[key]; ok {
+		return ch, false
+	}
+	ch := make(chan struct{})
+	g.inflight[key] = ch
+	return ch, true
+}
+
+// leave releases key and closes done, waking any followers that joined while the leader was
+// working. Only the leader returned by join should call leave.
+func (g *singleflightGroup) leave(key string, done chan struct{}) {
+	g.mu.Lock()
+	delete(g.inflight, key)
+	g.mu.Unlock()
+	close(done)
+}
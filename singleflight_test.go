@@ -0,0 +1,75 @@
+package httpcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleflightGroupCoalescesConcurrentCalls(t *testing.T) {
+	var g singleflightGroup
+	var calls int32
+	const n = 10
+
+	// release is closed once every goroutine is believed to have called Do, so the
+	// in-flight call's fn only completes after all of them have had a chance to join it
+	// rather than start their own.
+	var started sync.WaitGroup
+	started.Add(n)
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			started.Done()
+			v, err := g.Do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "value", nil
+			})
+			if err != nil {
+				t.Errorf("Do returned error: %s", err)
+			}
+			results[i] = v
+		}(i)
+	}
+
+	started.Wait()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn was called %d times, want 1", calls)
+	}
+	for i, v := range results {
+		if v != "value" {
+			t.Errorf("results[%d] = %v, want %q", i, v, "value")
+		}
+	}
+}
+
+func TestSingleflightGroupSeparateKeysRunIndependently(t *testing.T) {
+	var g singleflightGroup
+	var calls int32
+
+	v1, _ := g.Do("a", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return "a-value", nil
+	})
+	v2, _ := g.Do("b", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return "b-value", nil
+	})
+
+	if calls != 2 {
+		t.Errorf("fn was called %d times, want 2", calls)
+	}
+	if v1 != "a-value" || v2 != "b-value" {
+		t.Errorf("Do(%q)=%v, Do(%q)=%v", "a", v1, "b", v2)
+	}
+}
@@ -0,0 +1,98 @@
+package httpcache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ErrCacheMiss is returned by StreamingCache.NewReader when no entry exists for the
+// requested key.
+var ErrCacheMiss = errors.New("httpcache: no entry for key")
+
+// StreamingCache is implemented by a Cache backend that can write and read response bytes
+// incrementally instead of buffering an entire response in memory. When a Transport's Cache
+// implements StreamingCache, it is preferred over Cache.Set for storing a response body, so
+// memory use stays bounded regardless of how large that body is.
+//
+// The bytes written to, and read back from, a streaming entry are the same raw HTTP/1.x wire
+// representation (status line, headers, body) that Cache.Set is given today; Transport writes
+// that representation to NewWriter incrementally as the client reads the response, and
+// reconstructs the response from whatever NewReader returns.
+type StreamingCache interface {
+	Cache
+	// NewWriter returns a CacheWriter that streams a response's raw wire bytes to storage
+	// under key. The entry must not become visible to Get or NewReader until Close is called;
+	// see CacheWriter and TeeReadCloser.
+	NewWriter(key string) (CacheWriter, error)
+	// NewReader returns a reader over the raw wire bytes previously stored under key, along
+	// with its already-parsed headers, or ErrCacheMiss if no entry exists.
+	NewReader(key string) (io.ReadCloser, http.Header, error)
+}
+
+// CacheWriter is returned by StreamingCache.NewWriter. Exactly one of Close or Abort is called
+// on it, never both: Close commits the bytes written so far, making the entry visible to Get
+// and NewReader; Abort releases whatever resources the writer holds (a temp file descriptor,
+// a partially-written buffer) without committing anything, for a write that didn't finish
+// successfully and will never be read back.
+type CacheWriter interface {
+	io.Writer
+	Close() error
+	Abort() error
+}
+
+// TeeReadCloser wraps a response body so that, as it's read, the bytes are also written to w.
+// The write is committed by closing w only once the body has been read through to EOF without
+// error; an early or failed read instead calls w.Abort, so a StreamingCache implementation
+// releases whatever it was holding for the partial write (e.g. an open temp file) instead of
+// leaking it for the life of the process.
+type TeeReadCloser struct {
+	rc   io.ReadCloser
+	w    CacheWriter
+	eof  bool
+	fail bool
+	done bool
+}
+
+// NewTeeReadCloser returns a TeeReadCloser that mirrors reads from rc into w.
+func NewTeeReadCloser(rc io.ReadCloser, w CacheWriter) *TeeReadCloser {
+	return &TeeReadCloser{rc: rc, w: w}
+}
+
+// Read implements io.Reader, mirroring every successfully-read byte into the wrapped writer.
+func (t *TeeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 && !t.fail {
+		if _, werr := t.w.Write(p[:n]); werr != nil {
+			t.fail = true
+		}
+	}
+	switch err {
+	case nil:
+	case io.EOF:
+		t.eof = true
+	default:
+		t.fail = true
+	}
+	return n, err
+}
+
+// Close closes the underlying body and, if it was read through to EOF without error, commits
+// the mirrored write by closing w. Otherwise it calls w.Abort, so the StreamingCache releases
+// the partial write's resources instead of leaving the writer open indefinitely. Later calls
+// only close the underlying body again, so w sees exactly one Close or Abort.
+func (t *TeeReadCloser) Close() error {
+	err := t.rc.Close()
+	if t.done {
+		return err
+	}
+	t.done = true
+	if t.eof && !t.fail {
+		if werr := t.w.Close(); werr != nil && err == nil {
+			err = werr
+		}
+	} else if werr := t.w.Abort(); werr != nil && err == nil {
+		err = werr
+	}
+	return err
+}
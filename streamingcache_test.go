@@ -0,0 +1,236 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// memoryStreamingCache is a minimal StreamingCache used to exercise Transport's streaming
+// path in tests. Entries only become visible once their writer is closed successfully.
+type memoryStreamingCache struct {
+	mu      sync.Mutex
+	items   map[string][]byte
+	writers int32
+}
+
+func newMemoryStreamingCache() *memoryStreamingCache {
+	return &memoryStreamingCache{items: map[string][]byte{}}
+}
+
+func (c *memoryStreamingCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.items[key]
+	return b, ok
+}
+
+func (c *memoryStreamingCache) Set(key string, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[key] = b
+}
+
+func (c *memoryStreamingCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.items, key)
+}
+
+type stagedWriteCloser struct {
+	c       *memoryStreamingCache
+	key     string
+	buf     bytes.Buffer
+	aborted bool
+}
+
+func (w *stagedWriteCloser) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *stagedWriteCloser) Close() error {
+	w.c.Set(w.key, append([]byte(nil), w.buf.Bytes()...))
+	return nil
+}
+
+func (w *stagedWriteCloser) Abort() error {
+	w.aborted = true
+	return nil
+}
+
+func (c *memoryStreamingCache) NewWriter(key string) (CacheWriter, error) {
+	return &stagedWriteCloser{c: c, key: key}, nil
+}
+
+func (c *memoryStreamingCache) NewReader(key string) (io.ReadCloser, http.Header, error) {
+	b, ok := c.Get(key)
+	if !ok {
+		return nil, nil, ErrCacheMiss
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), resp.Header, nil
+}
+
+func TestTeeReadCloserCommitsOnFullRead(t *testing.T) {
+	var w bytes.Buffer
+	rc := ioutil.NopCloser(bytes.NewReader([]byte("hello world")))
+	tee := NewTeeReadCloser(rc, nopWriteCloser{&w})
+
+	got, err := ioutil.ReadAll(tee)
+	if err != nil {
+		t.Fatalf("ReadAll error: %s", err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("ReadAll = %q, want %q", got, "hello world")
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	if w.String() != "hello world" {
+		t.Errorf("mirrored write = %q, want %q", w.String(), "hello world")
+	}
+}
+
+type nopWriteCloser struct{ w io.Writer }
+
+func (n nopWriteCloser) Write(p []byte) (int, error) { return n.w.Write(p) }
+func (n nopWriteCloser) Close() error                { return nil }
+func (n nopWriteCloser) Abort() error                { return nil }
+
+// trackingWriteCloser simulates a StreamingCache writer backed by a real resource (e.g. a temp
+// file): aborted records that the resource was released, so an incomplete write doesn't leak it.
+type trackingWriteCloser struct {
+	buf     bytes.Buffer
+	closed  bool
+	aborted bool
+}
+
+func (w *trackingWriteCloser) Write(p []byte) (int, error) { return w.buf.Write(p) }
+func (w *trackingWriteCloser) Close() error                { w.closed = true; return nil }
+func (w *trackingWriteCloser) Abort() error                { w.aborted = true; return nil }
+
+func TestTeeReadCloserDiscardsOnPartialRead(t *testing.T) {
+	w := &trackingWriteCloser{}
+	rc := ioutil.NopCloser(bytes.NewReader([]byte("hello world")))
+	tee := NewTeeReadCloser(rc, w)
+
+	buf := make([]byte, 5)
+	if _, err := tee.Read(buf); err != nil {
+		t.Fatalf("Read error: %s", err)
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	if w.closed {
+		t.Errorf("writer should not be closed (committed) when the body wasn't fully read")
+	}
+	if !w.aborted {
+		t.Errorf("writer should be aborted (resources released) when the body wasn't fully read")
+	}
+}
+
+func TestTeeReadCloserDiscardsOnReadError(t *testing.T) {
+	w := &trackingWriteCloser{}
+	rc := ioutil.NopCloser(errorReader{})
+	tee := NewTeeReadCloser(rc, w)
+
+	_, err := ioutil.ReadAll(tee)
+	if err == nil {
+		t.Fatalf("expected a read error")
+	}
+	tee.Close()
+	if w.closed {
+		t.Errorf("writer should not be closed (committed) after a read error")
+	}
+	if !w.aborted {
+		t.Errorf("writer should be aborted (resources released) after a read error")
+	}
+}
+
+type errorReader struct{}
+
+func (errorReader) Read([]byte) (int, error) { return 0, errors.New("boom") }
+
+// countingStreamingCache wraps memoryStreamingCache to record how an entry is read back:
+// through Get, which forces the whole cached value to already be a []byte, or through
+// NewReader, which doesn't.
+type countingStreamingCache struct {
+	*memoryStreamingCache
+	gets       int32
+	newReaders int32
+}
+
+func (c *countingStreamingCache) Get(key string) ([]byte, bool) {
+	atomic.AddInt32(&c.gets, 1)
+	return c.memoryStreamingCache.Get(key)
+}
+
+func (c *countingStreamingCache) NewReader(key string) (io.ReadCloser, http.Header, error) {
+	atomic.AddInt32(&c.newReaders, 1)
+	return c.memoryStreamingCache.NewReader(key)
+}
+
+func TestCachedResponseForKeyPrefersNewReaderOverGet(t *testing.T) {
+	cache := &countingStreamingCache{memoryStreamingCache: newMemoryStreamingCache()}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Cache-Control": {"max-age=60"}},
+		Body:       ioutil.NopCloser(strings.NewReader("hello")),
+	}
+	var raw bytes.Buffer
+	if err := resp.Write(&raw); err != nil {
+		t.Fatalf("dumping response: %s", err)
+	}
+
+	w, err := cache.NewWriter("key")
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	if _, err := w.Write(raw.Bytes()); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	atomic.StoreInt32(&cache.gets, 0)
+
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	got, err := cachedResponseForKey(cache, "key", req)
+	if err != nil {
+		t.Fatalf("cachedResponseForKey: %s", err)
+	}
+	if got == nil {
+		t.Fatal("cachedResponseForKey returned no response for a populated key")
+	}
+	body, err := ioutil.ReadAll(got.Body)
+	if err != nil {
+		t.Fatalf("reading response body: %s", err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("body = %q, want %q", body, "hello")
+	}
+
+	if n := atomic.LoadInt32(&cache.newReaders); n == 0 {
+		t.Errorf("expected cachedResponseForKey to read the entry through NewReader")
+	}
+	if n := atomic.LoadInt32(&cache.gets); n != 0 {
+		t.Errorf("cachedResponseForKey called Get %d times, want 0: a StreamingCache backend should be read through NewReader, not Get", n)
+	}
+}